@@ -0,0 +1,69 @@
+/*
+* Copyright 2020, Offchain Labs, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package checkpointing
+
+// CheckpointBackend is the raw key-value storage that RollupCheckpointerImpl
+// writes the `metadata`, `manifest:`, `contents:`, `links:` and `deadqueue`
+// entries through. Splitting it out of machine.CheckpointStorage lets more
+// than one storage engine sit underneath the checkpointer: the existing
+// cmachine-backed store, or a pure-Go store such as boltCheckpointBackend.
+type CheckpointBackend interface {
+	Get(key []byte) []byte
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	Iterate(prefix []byte, f func(key, value []byte) bool) error
+
+	// NewBatch returns a batch that callers should use to group the writes
+	// belonging to a single SaveCheckpoint call, so they can be committed
+	// atomically by backends that support it.
+	NewBatch() CheckpointBatch
+
+	Close() error
+}
+
+// CheckpointBatch groups a set of CheckpointBackend writes so they can be
+// committed together.
+type CheckpointBatch interface {
+	Put(key []byte, value []byte)
+	Delete(key []byte)
+	Commit() error
+}
+
+// Key prefixes shared by every CheckpointBackend implementation.
+var (
+	metadataKey       = []byte("metadata")
+	manifestPrefix    = []byte("manifest:")
+	contentsPrefix    = []byte("contents:")
+	linksPrefix       = []byte("links:")
+	deadQueueKey      = []byte("deadqueue")
+	valuePrefix       = []byte("value:")
+	machinePrefix     = []byte("machine:")
+	initialMachineKey = []byte("initialmachine")
+)
+
+// BackendKind selects which CheckpointBackend a RollupCheckpointerImplFactory
+// builds its storage on top of.
+type BackendKind int
+
+const (
+	// CMachineBackend checkpoints through the C++ AVM machine store
+	// (cmachine.NewCheckpoint). This is the default, matching existing
+	// deployments.
+	CMachineBackend BackendKind = iota
+	// BoltBackend checkpoints through an embedded, pure-Go bbolt database.
+	BoltBackend
+)
@@ -0,0 +1,183 @@
+/*
+* Copyright 2020, Offchain Labs, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package checkpointing
+
+import (
+	"bytes"
+
+	"go.etcd.io/bbolt"
+)
+
+var (
+	metadataBucket  = []byte("metadata")
+	manifestBucket  = []byte("manifest")
+	contentsBucket  = []byte("contents")
+	linksBucket     = []byte("links")
+	deadQueueBucket = []byte("deadqueue")
+	valuesBucket    = []byte("values")
+	machinesBucket  = []byte("machines")
+)
+
+var checkpointBuckets = [][]byte{
+	metadataBucket,
+	manifestBucket,
+	contentsBucket,
+	linksBucket,
+	deadQueueBucket,
+	valuesBucket,
+	machinesBucket,
+}
+
+// boltCheckpointBackend is a CheckpointBackend backed by a single bbolt
+// database file, with one bucket per key prefix already in use by
+// RollupCheckpointerImpl. It requires no cgo and no external process, so it
+// can run anywhere the validator binary itself runs.
+type boltCheckpointBackend struct {
+	db *bbolt.DB
+}
+
+func newBoltCheckpointBackend(path string) (*boltCheckpointBackend, error) {
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range checkpointBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &boltCheckpointBackend{db: db}, nil
+}
+
+// bucketAndKey maps one of the flat, prefixed keys used throughout
+// checkpointing.go (e.g. "manifest:<id>") onto the bucket/sub-key pair bbolt
+// needs to address it.
+func bucketAndKey(key []byte) ([]byte, []byte) {
+	switch {
+	case bytes.HasPrefix(key, manifestPrefix):
+		return manifestBucket, key[len(manifestPrefix):]
+	case bytes.HasPrefix(key, contentsPrefix):
+		return contentsBucket, key[len(contentsPrefix):]
+	case bytes.HasPrefix(key, linksPrefix):
+		return linksBucket, key[len(linksPrefix):]
+	case bytes.Equal(key, deadQueueKey):
+		return deadQueueBucket, key
+	case bytes.HasPrefix(key, valuePrefix):
+		return valuesBucket, key[len(valuePrefix):]
+	case bytes.HasPrefix(key, machinePrefix):
+		return machinesBucket, key[len(machinePrefix):]
+	default:
+		return metadataBucket, key
+	}
+}
+
+func (b *boltCheckpointBackend) Get(key []byte) []byte {
+	bucket, subKey := bucketAndKey(key)
+	var ret []byte
+	_ = b.db.View(func(tx *bbolt.Tx) error {
+		if val := tx.Bucket(bucket).Get(subKey); val != nil {
+			ret = append([]byte{}, val...)
+		}
+		return nil
+	})
+	return ret
+}
+
+func (b *boltCheckpointBackend) Put(key []byte, value []byte) error {
+	bucket, subKey := bucketAndKey(key)
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).Put(subKey, value)
+	})
+}
+
+func (b *boltCheckpointBackend) Delete(key []byte) error {
+	bucket, subKey := bucketAndKey(key)
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(bucket).Delete(subKey)
+	})
+}
+
+func (b *boltCheckpointBackend) Iterate(prefix []byte, f func(key, value []byte) bool) error {
+	bucket, subPrefix := bucketAndKey(prefix)
+	return b.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, v := c.Seek(subPrefix); k != nil && bytes.HasPrefix(k, subPrefix); k, v = c.Next() {
+			fullKey := append(append([]byte{}, prefix[:len(prefix)-len(subPrefix)]...), k...)
+			if !f(fullKey, v) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (b *boltCheckpointBackend) NewBatch() CheckpointBatch {
+	return &boltCheckpointBatch{backend: b}
+}
+
+func (b *boltCheckpointBackend) Close() error {
+	return b.db.Close()
+}
+
+// boltCheckpointBatch collects the writes made while saving a single
+// checkpoint and commits them in one bbolt transaction, so the metadata,
+// manifest, contents and links entries it contains either all land or none
+// do. This replaces the previous best-effort sequence of independent
+// SaveData calls, which could leave the database half-written after a crash.
+type boltCheckpointBatch struct {
+	backend *boltCheckpointBackend
+	puts    []boltBatchPut
+	deletes [][]byte
+}
+
+type boltBatchPut struct {
+	key   []byte
+	value []byte
+}
+
+func (b *boltCheckpointBatch) Put(key []byte, value []byte) {
+	b.puts = append(b.puts, boltBatchPut{key, value})
+}
+
+func (b *boltCheckpointBatch) Delete(key []byte) {
+	b.deletes = append(b.deletes, key)
+}
+
+func (b *boltCheckpointBatch) Commit() error {
+	return b.backend.db.Update(func(tx *bbolt.Tx) error {
+		for _, d := range b.deletes {
+			bucket, subKey := bucketAndKey(d)
+			if err := tx.Bucket(bucket).Delete(subKey); err != nil {
+				return err
+			}
+		}
+		for _, p := range b.puts {
+			bucket, subKey := bucketAndKey(p.key)
+			if err := tx.Bucket(bucket).Put(subKey, p.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
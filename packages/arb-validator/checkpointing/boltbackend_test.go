@@ -0,0 +1,144 @@
+/*
+* Copyright 2020, Offchain Labs, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package checkpointing
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func newTestBoltBackend(t *testing.T) *boltCheckpointBackend {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "checkpoint.db")
+	backend, err := newBoltCheckpointBackend(path)
+	if err != nil {
+		t.Fatalf("newBoltCheckpointBackend: %v", err)
+	}
+	t.Cleanup(func() { _ = backend.Close() })
+	return backend
+}
+
+func TestBoltCheckpointBackendGetPutDelete(t *testing.T) {
+	backend := newTestBoltBackend(t)
+	key := append(append([]byte{}, manifestPrefix...), []byte("abc")...)
+
+	if got := backend.Get(key); got != nil {
+		t.Fatalf("Get on empty backend = %v, want nil", got)
+	}
+
+	if err := backend.Put(key, []byte("hello")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := backend.Get(key); !bytes.Equal(got, []byte("hello")) {
+		t.Fatalf("Get = %q, want %q", got, "hello")
+	}
+
+	if err := backend.Delete(key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if got := backend.Get(key); got != nil {
+		t.Fatalf("Get after Delete = %v, want nil", got)
+	}
+}
+
+func TestBoltCheckpointBackendIterate(t *testing.T) {
+	backend := newTestBoltBackend(t)
+
+	want := map[string]string{"a": "1", "b": "2", "c": "3"}
+	for k, v := range want {
+		key := append(append([]byte{}, manifestPrefix...), []byte(k)...)
+		if err := backend.Put(key, []byte(v)); err != nil {
+			t.Fatalf("Put(%s): %v", k, err)
+		}
+	}
+	// An entry in a different bucket must not show up in a manifestPrefix
+	// iteration.
+	if err := backend.Put(append(append([]byte{}, contentsPrefix...), []byte("a")...), []byte("other")); err != nil {
+		t.Fatalf("Put(contents): %v", err)
+	}
+
+	got := make(map[string]string)
+	err := backend.Iterate(manifestPrefix, func(key, value []byte) bool {
+		got[string(key[len(manifestPrefix):])] = string(value)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Iterate: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Iterate returned %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("Iterate()[%s] = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestBoltCheckpointBatchCommitAppliesPutsAndDeletes(t *testing.T) {
+	backend := newTestBoltBackend(t)
+
+	existingKey := append(append([]byte{}, manifestPrefix...), []byte("existing")...)
+	if err := backend.Put(existingKey, []byte("old")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	batch := backend.NewBatch()
+	newKey := append(append([]byte{}, contentsPrefix...), []byte("new")...)
+	batch.Put(newKey, []byte("value"))
+	batch.Delete(existingKey)
+	if err := batch.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	if got := backend.Get(newKey); !bytes.Equal(got, []byte("value")) {
+		t.Fatalf("Get(new) = %q, want %q", got, "value")
+	}
+	if got := backend.Get(existingKey); got != nil {
+		t.Fatalf("Get(existing) = %v, want nil after batched delete", got)
+	}
+}
+
+func TestBucketAndKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        []byte
+		wantBucket []byte
+		wantSubKey []byte
+	}{
+		{"manifest", append(append([]byte{}, manifestPrefix...), []byte("h1")...), manifestBucket, []byte("h1")},
+		{"contents", append(append([]byte{}, contentsPrefix...), []byte("h2")...), contentsBucket, []byte("h2")},
+		{"links", append(append([]byte{}, linksPrefix...), []byte("h3")...), linksBucket, []byte("h3")},
+		{"value", append(append([]byte{}, valuePrefix...), []byte("h4")...), valuesBucket, []byte("h4")},
+		{"machine", append(append([]byte{}, machinePrefix...), []byte("h5")...), machinesBucket, []byte("h5")},
+		{"deadqueue", deadQueueKey, deadQueueBucket, deadQueueKey},
+		{"metadata", metadataKey, metadataBucket, metadataKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket, subKey := bucketAndKey(tt.key)
+			if !bytes.Equal(bucket, tt.wantBucket) {
+				t.Fatalf("bucket = %q, want %q", bucket, tt.wantBucket)
+			}
+			if !bytes.Equal(subKey, tt.wantSubKey) {
+				t.Fatalf("subKey = %q, want %q", subKey, tt.wantSubKey)
+			}
+		})
+	}
+}
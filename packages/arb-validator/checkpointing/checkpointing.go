@@ -19,6 +19,7 @@ package checkpointing
 import (
 	"context"
 	"errors"
+	"io"
 	"log"
 	"math/big"
 	"os"
@@ -41,6 +42,21 @@ type RollupCheckpointer interface {
 	RestoreLatestState(context.Context, arbbridge.ArbClient, func([]byte, RestoreContext) error) error
 	GetInitialMachine() (machine.Machine, error)
 	AsyncSaveCheckpoint(blockId *common.BlockId, contents []byte, cpCtx CheckpointContext, closeWhenDone chan struct{})
+	ExportSnapshot(ctx context.Context, w io.Writer, blockId *common.BlockId) error
+	ImportSnapshot(ctx context.Context, r io.Reader) error
+}
+
+// CompressionOptions controls whether SaveCheckpoint compresses the
+// contents/manifest blobs it writes, and with which codec/level.
+type CompressionOptions struct {
+	Enabled bool
+	Codec   CompressionCodec
+	Level   int
+}
+
+// DefaultCompressionOptions enables zstd compression at its default level.
+func DefaultCompressionOptions() CompressionOptions {
+	return CompressionOptions{Enabled: true, Codec: CompressionCodec_COMPRESSION_ZSTD}
 }
 
 type RollupCheckpointerImplFactory struct {
@@ -48,7 +64,13 @@ type RollupCheckpointerImplFactory struct {
 	arbCodeFilePath string
 	databasePath    string
 	maxReorgDepth   *big.Int
-	forceFreshStart bool
+	backendKind     BackendKind
+	compression     CompressionOptions
+	// restoreSnapshotPath, if set, is a file previously written by
+	// ExportSnapshot. New() imports it into the freshly opened store,
+	// replacing the old forceFreshStart-plus-os.RemoveAll path operators
+	// used to seed a validator without a trusted starting point.
+	restoreSnapshotPath string
 }
 
 func NewRollupCheckpointerImplFactory(
@@ -56,7 +78,9 @@ func NewRollupCheckpointerImplFactory(
 	arbitrumCodeFilePath string,
 	databasePath string,
 	maxReorgDepth *big.Int,
-	forceFreshStart bool,
+	backendKind BackendKind,
+	compression CompressionOptions,
+	restoreSnapshotPath string,
 ) RollupCheckpointerFactory {
 	if databasePath == "" {
 		databasePath = MakeCheckpointDatabasePath(rollupAddr)
@@ -66,7 +90,9 @@ func NewRollupCheckpointerImplFactory(
 		arbitrumCodeFilePath,
 		databasePath,
 		maxReorgDepth,
-		forceFreshStart,
+		backendKind,
+		compression,
+		restoreSnapshotPath,
 	}
 }
 
@@ -74,6 +100,12 @@ type RollupCheckpointerImpl struct {
 	st            machine.CheckpointStorage
 	maxReorgDepth *big.Int
 	asyncWriter   *asyncCheckpointWriter
+	compression   CompressionOptions
+	// backend is non-nil when st is backed by a CheckpointBackend (e.g.
+	// BoltBackend), letting SaveCheckpoint commit metadata/manifest/
+	// contents/links as a single atomic batch. It stays nil for the
+	// cmachine backend, which has no such raw KV handle to batch through.
+	backend CheckpointBackend
 }
 
 const checkpointDatabasePathBase = "/tmp/arb-validator-checkpoint-"
@@ -83,55 +115,97 @@ func MakeCheckpointDatabasePath(rollupAddr common.Address) string {
 }
 
 func (fac *RollupCheckpointerImplFactory) New(ctx context.Context) RollupCheckpointer {
-	if fac.forceFreshStart {
-		// for testing only -- use production checkpointer but delete old database first
-		if err := os.RemoveAll(fac.databasePath); err != nil {
+	var st machine.CheckpointStorage
+	var backend CheckpointBackend
+	switch fac.backendKind {
+	case BoltBackend:
+		boltBackend, err := newBoltCheckpointBackend(fac.databasePath)
+		if err != nil {
 			log.Fatal(err)
 		}
-		fac.forceFreshStart = false
-	}
-	cCheckpointer, err := cmachine.NewCheckpoint(fac.databasePath, fac.arbCodeFilePath)
-	if err != nil {
-		log.Fatal(err)
+		if err := ensureInitialMachine(boltBackend, fac.arbCodeFilePath); err != nil {
+			log.Fatal(err)
+		}
+		backend = boltBackend
+		st = newKVCheckpointStorage(backend)
+	default:
+		cCheckpointer, err := cmachine.NewCheckpoint(fac.databasePath, fac.arbCodeFilePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		st = cCheckpointer
 	}
 	ret := &RollupCheckpointerImpl{
 		maxReorgDepth: fac.maxReorgDepth,
-		st:            cCheckpointer,
+		st:            st,
+		compression:   fac.compression,
+		backend:       backend,
 	}
 	ret.asyncWriter = NewAsyncCheckpointWriter(ctx, ret)
+
+	if fac.restoreSnapshotPath != "" {
+		if err := ret.importSnapshotFile(ctx, fac.restoreSnapshotPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	return ret
 }
 
+// importSnapshotFile opens a snapshot file written by ExportSnapshot and
+// imports it, giving operators a safe way to seed a fresh validator from a
+// trusted peer's snapshot instead of replaying the chain or, as before,
+// deleting the local database directory outright.
+func (rcp *RollupCheckpointerImpl) importSnapshotFile(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return rcp.ImportSnapshot(ctx, f)
+}
+
 func (rcp *RollupCheckpointerImpl) _saveCheckpoint(
 	id *common.BlockId,
 	contents []byte,
 	checkpointCtx CheckpointContext,
 ) error {
-	// read in metadata
+	// read in metadata, or create it if it doesn't already exist
 	var metadataBuf *CheckpointMetadata
 	var newestInCp *common.BlockId
 	rawMetadata := rcp.RestoreMetadata()
 
-	// read in metadata, or create it if it doesn't already exist
 	if rawMetadata == nil || len(rawMetadata) == 0 {
 		idBuf := id.MarshalToBuf()
+		codec := rcp.compression.Codec
+		if !rcp.compression.Enabled {
+			codec = CompressionCodec_COMPRESSION_NONE
+		}
 		metadataBuf = &CheckpointMetadata{
 			FormatVersion: 1,
 			Oldest:        idBuf,
 			Newest:        idBuf,
+			Compression:   codec,
 		}
-		buf, err := proto.Marshal(metadataBuf)
-		if err != nil {
-			return err
-		}
-		rcp.SaveMetadata(buf)
+		newestInCp = id
 	} else {
 		metadataBuf = &CheckpointMetadata{}
 		if err := proto.Unmarshal(rawMetadata, metadataBuf); err != nil {
 			return err
 		}
+		newestInCp = metadataBuf.Newest.Unmarshal()
+	}
+
+	// the metadata update that records this checkpoint as newest is handed
+	// to SaveCheckpoint together with the checkpoint's own data, below. On a
+	// CheckpointBackend store the two commit in one batch; on the cmachine
+	// store they are still written one after another.
+	metadataBuf.Newest = id.MarshalToBuf()
+	metadataBytes, err := proto.Marshal(metadataBuf)
+	if err != nil {
+		return err
 	}
-	newestInCp = metadataBuf.Newest.Unmarshal()
+
 	// save all of the data for this checkpoint
 	rcp.SaveCheckpoint(
 		id,
@@ -140,16 +214,9 @@ func (rcp *RollupCheckpointerImpl) _saveCheckpoint(
 		checkpointCtx.Manifest(),
 		checkpointCtx.Values(),
 		checkpointCtx.Machines(),
+		metadataBytes,
 	)
 
-	// update the metadata to include this checkpoint
-	metadataBuf.Newest = id.MarshalToBuf()
-	buf, err := proto.Marshal(metadataBuf)
-	if err != nil {
-		return err
-	}
-	rcp.SaveMetadata(buf)
-
 	return nil
 }
 
@@ -200,7 +267,10 @@ func (rcp *RollupCheckpointerImpl) RestoreCheckpoint(blockId *common.BlockId) ([
 
 	// read contents
 	contentsKey := getContentsKey(blockId)
-	contentBytes := rcp.st.GetData(contentsKey)
+	contentBytes, err := decompressValue(rcp.st.GetData(contentsKey))
+	if err != nil {
+		return nil, nil, err
+	}
 
 	return contentBytes, rcp, nil
 }
@@ -253,6 +323,13 @@ func (rcp *RollupCheckpointerImpl) RestoreMetadata() []byte {
 	return rcp.st.GetData([]byte("metadata"))
 }
 
+// SaveCheckpoint persists the values/machines a checkpoint's manifest
+// references, then commits the metadata/manifest/contents/links entries for
+// blockId itself, along with prevBlockId's links entry updated to point at
+// blockId. When the underlying store is a CheckpointBackend (e.g.
+// BoltBackend), those last five writes land in a single batch transaction,
+// so a crash can never leave the database with some of them written and
+// others missing.
 func (rcp *RollupCheckpointerImpl) SaveCheckpoint(
 	blockId *common.BlockId,
 	prevBlockId *common.BlockId,
@@ -260,6 +337,7 @@ func (rcp *RollupCheckpointerImpl) SaveCheckpoint(
 	manifest *CheckpointManifest,
 	values map[common.Hash]value.Value,
 	machines map[common.Hash]machine.Machine,
+	metadataBytes []byte,
 ) {
 	for _, val := range values {
 		rcp.st.SaveValue(val)
@@ -276,49 +354,65 @@ func (rcp *RollupCheckpointerImpl) SaveCheckpoint(
 	if err != nil {
 		log.Fatal(err)
 	}
-	rcp.st.SaveData(getManifestKey(blockId), manifestBuf)
 
-	rcp.st.SaveData(getContentsKey(blockId), contents)
-
-	rcp._updateNextPointer(prevBlockId, blockId)
-	rcp._setBothPointers(blockId, prevBlockId, blockId)
-}
-
-func (rcp *RollupCheckpointerImpl) _setBothPointers(id, prev, next *common.BlockId) {
-	links := &CheckpointLinks{
-		Prev: prev.MarshalToBuf(),
-		Next: next.MarshalToBuf(),
+	nextPointerKey, nextPointerBuf, err := rcp._nextPointerBuf(prevBlockId, blockId)
+	if err != nil {
+		log.Fatal(err)
 	}
-	linksBuf, err := proto.Marshal(links)
+	bothPointersBuf, err := proto.Marshal(&CheckpointLinks{
+		Prev: prevBlockId.MarshalToBuf(),
+		Next: blockId.MarshalToBuf(),
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	rcp.st.SaveData(getLinksKey(id), linksBuf)
+
+	if rcp.backend != nil {
+		batch := rcp.backend.NewBatch()
+		batch.Put(metadataKey, metadataBytes)
+		batch.Put(getManifestKey(blockId), rcp.maybeCompress(manifestBuf))
+		batch.Put(getContentsKey(blockId), rcp.maybeCompress(contents))
+		batch.Put(nextPointerKey, nextPointerBuf)
+		batch.Put(getLinksKey(blockId), bothPointersBuf)
+		if err := batch.Commit(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	rcp.SaveMetadata(metadataBytes)
+	rcp.st.SaveData(getManifestKey(blockId), rcp.maybeCompress(manifestBuf))
+	rcp.st.SaveData(getContentsKey(blockId), rcp.maybeCompress(contents))
+	rcp.st.SaveData(nextPointerKey, nextPointerBuf)
+	rcp.st.SaveData(getLinksKey(blockId), bothPointersBuf)
 }
 
-func (rcp *RollupCheckpointerImpl) _updatePrevPointer(id, prev *common.BlockId) {
+// _nextPointerBuf computes the updated links entry for id (prevBlockId) with
+// its Next pointer set to next (blockId), without writing it - so callers
+// can fold the write into a single batch alongside the rest of a checkpoint.
+func (rcp *RollupCheckpointerImpl) _nextPointerBuf(id, next *common.BlockId) ([]byte, []byte, error) {
 	key := getLinksKey(id)
 	linksBuf := rcp.st.GetData(key)
 	links := &CheckpointLinks{}
 	if err := proto.Unmarshal(linksBuf, links); err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
-	links.Prev = prev.MarshalToBuf()
-	linksBuf, err := proto.Marshal(links)
+	links.Next = next.MarshalToBuf()
+	buf, err := proto.Marshal(links)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
-	rcp.st.SaveData(key, linksBuf)
+	return key, buf, nil
 }
 
-func (rcp *RollupCheckpointerImpl) _updateNextPointer(id, next *common.BlockId) {
+func (rcp *RollupCheckpointerImpl) _updatePrevPointer(id, prev *common.BlockId) {
 	key := getLinksKey(id)
 	linksBuf := rcp.st.GetData(key)
 	links := &CheckpointLinks{}
 	if err := proto.Unmarshal(linksBuf, links); err != nil {
 		log.Fatal(err)
 	}
-	links.Next = next.MarshalToBuf()
+	links.Prev = prev.MarshalToBuf()
 	linksBuf, err := proto.Marshal(links)
 	if err != nil {
 		log.Fatal(err)
@@ -445,12 +539,14 @@ func (rcp *RollupCheckpointerImpl) deleteSomeOldCheckpoints() {
 		return
 	}
 	rcp.st.SaveData([]byte("deadqueue"), queueBytes)
+
+	rcp.migrateUncompressedEntries()
 }
 
 func (rcp *RollupCheckpointerImpl) DeleteOneOldCheckpoint(blockId *common.BlockId) {
 	// assume metadata has already been updated to reflect deletion
-	manifestBytes := rcp.st.GetData(getManifestKey(blockId))
-	if manifestBytes == nil {
+	manifestBytes, err := decompressValue(rcp.st.GetData(getManifestKey(blockId)))
+	if err != nil || manifestBytes == nil {
 		return
 	}
 	manifestBuf := &CheckpointManifest{}
@@ -0,0 +1,219 @@
+/*
+* Copyright 2020, Offchain Labs, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package checkpointing
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/offchainlabs/arbitrum/packages/arb-util/common"
+)
+
+// Every compressed value written by SaveCheckpoint is prefixed with a single
+// header byte identifying the codec it was written with. Entries written
+// before this change have no header, so readers that see an unrecognized
+// header fall back to treating the whole value as uncompressed data.
+const (
+	compressionHeaderNone byte = 0
+	compressionHeaderZstd byte = 1
+	compressionHeaderGzip byte = 2
+)
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// zstdEncodersByLevel caches one encoder per requested zstd level, built
+// lazily, since zstd.NewWriter isn't free enough to call per value.
+var zstdEncodersByLevel sync.Map // map[int]*zstd.Encoder
+
+// zstdEncoderForLevel returns the cached encoder for level, or the
+// package-default encoder for level 0 or if building an encoder fails. Any
+// other level is mapped onto a zstd speed setting by EncoderLevelFromZstd.
+func zstdEncoderForLevel(level int) *zstd.Encoder {
+	if level == 0 {
+		return zstdEncoder
+	}
+	if enc, ok := zstdEncodersByLevel.Load(level); ok {
+		return enc.(*zstd.Encoder)
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	if err != nil {
+		return zstdEncoder
+	}
+	actual, _ := zstdEncodersByLevel.LoadOrStore(level, enc)
+	return actual.(*zstd.Encoder)
+}
+
+// gzipLevel returns level unchanged if gzip supports it, falling back to
+// gzip.DefaultCompression for a level that isn't configured (0, the zero
+// value of CompressionOptions.Level) or that gzip doesn't support.
+func gzipLevel(level int) int {
+	if level == 0 || level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return gzip.DefaultCompression
+	}
+	return level
+}
+
+// compressValue compresses data with the given codec and level, and prepends
+// the header byte that identifies the codec. CompressionCodec_COMPRESSION_NONE
+// is a no-op aside from the header, so callers can always round-trip through
+// compressValue/decompressValue regardless of whether compression is
+// enabled. level is only consulted for codecs that support tuning
+// compression ratio vs. speed; a level of 0 means "use the codec's default".
+func compressValue(codec CompressionCodec, level int, data []byte) []byte {
+	switch codec {
+	case CompressionCodec_COMPRESSION_ZSTD:
+		enc := zstdEncoderForLevel(level)
+		compressed := enc.EncodeAll(data, make([]byte, 0, len(data)))
+		return append([]byte{compressionHeaderZstd}, compressed...)
+	case CompressionCodec_COMPRESSION_GZIP:
+		var buf bytes.Buffer
+		buf.WriteByte(compressionHeaderGzip)
+		gw, err := gzip.NewWriterLevel(&buf, gzipLevel(level))
+		if err != nil {
+			gw = gzip.NewWriter(&buf)
+		}
+		_, _ = gw.Write(data)
+		_ = gw.Close()
+		return buf.Bytes()
+	default:
+		return append([]byte{compressionHeaderNone}, data...)
+	}
+}
+
+// decompressValue reverses compressValue. It also transparently accepts
+// values written before the header byte existed: if the leading byte isn't
+// one of the recognized headers, the whole value is returned unchanged.
+func decompressValue(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	switch data[0] {
+	case compressionHeaderNone:
+		return data[1:], nil
+	case compressionHeaderZstd:
+		return zstdDecoder.DecodeAll(data[1:], nil)
+	case compressionHeaderGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		return ioutil.ReadAll(gr)
+	default:
+		// Pre-existing, unheadered entry from before compression support.
+		return data, nil
+	}
+}
+
+func isCompressed(data []byte) bool {
+	return len(data) > 0 && (data[0] == compressionHeaderZstd || data[0] == compressionHeaderGzip)
+}
+
+// maybeCompress applies the checkpointer's configured codec, or just tags
+// data as uncompressed if compression is disabled.
+func (rcp *RollupCheckpointerImpl) maybeCompress(data []byte) []byte {
+	if !rcp.compression.Enabled {
+		return compressValue(CompressionCodec_COMPRESSION_NONE, 0, data)
+	}
+	return compressValue(rcp.compression.Codec, rcp.compression.Level, data)
+}
+
+// migrateSomeCompressionEntriesPerRun bounds how much work
+// migrateUncompressedEntries does per call, so it can ride along with
+// deleteSomeOldCheckpoints without turning a routine prune into a
+// stop-the-world rewrite of the whole database.
+const migrateSomeCompressionEntriesPerRun = 16
+
+// migrateUncompressedEntries rewrites a bounded number of still-uncompressed
+// manifest/contents entries reachable from the oldest surviving checkpoints,
+// compressing them with the checkpointer's current codec. It is called from
+// deleteSomeOldCheckpoints so a long-lived database gradually converges on
+// the configured codec without needing a dedicated migration pass.
+func (rcp *RollupCheckpointerImpl) migrateUncompressedEntries() {
+	if !rcp.compression.Enabled {
+		return
+	}
+	rawMetadata := rcp.RestoreMetadata()
+	if len(rawMetadata) == 0 {
+		return
+	}
+	metadata := &CheckpointMetadata{}
+	if err := proto.Unmarshal(rawMetadata, metadata); err != nil {
+		return
+	}
+	if metadata.Compression == rcp.compression.Codec {
+		return
+	}
+
+	id := metadata.Oldest.Unmarshal()
+	migrated := 0
+	for id != nil && migrated < migrateSomeCompressionEntriesPerRun {
+		if rcp.migrateOneCheckpoint(id) {
+			migrated++
+		}
+
+		linksBytes := rcp.st.GetData(getLinksKey(id))
+		links := &CheckpointLinks{}
+		if err := proto.Unmarshal(linksBytes, links); err != nil {
+			break
+		}
+		next := links.Next.Unmarshal()
+		if next == nil || next.Height.Cmp(id.Height) <= 0 {
+			break
+		}
+		id = next
+	}
+
+	if id == nil || migrated < migrateSomeCompressionEntriesPerRun {
+		metadata.Compression = rcp.compression.Codec
+		if buf, err := proto.Marshal(metadata); err == nil {
+			rcp.SaveMetadata(buf)
+		}
+	}
+}
+
+// migrateOneCheckpoint rewrites a single checkpoint's contents/manifest
+// entries with the current codec if they aren't compressed yet; entries
+// already compressed with any codec are left as they are. It returns whether
+// it rewrote anything.
+func (rcp *RollupCheckpointerImpl) migrateOneCheckpoint(id *common.BlockId) bool {
+	rewrote := false
+
+	contentsKey := getContentsKey(id)
+	if raw := rcp.st.GetData(contentsKey); raw != nil && !isCompressed(raw) {
+		if plain, err := decompressValue(raw); err == nil {
+			rcp.st.SaveData(contentsKey, rcp.maybeCompress(plain))
+			rewrote = true
+		}
+	}
+
+	manifestKey := getManifestKey(id)
+	if raw := rcp.st.GetData(manifestKey); raw != nil && !isCompressed(raw) {
+		if plain, err := decompressValue(raw); err == nil {
+			rcp.st.SaveData(manifestKey, rcp.maybeCompress(plain))
+			rewrote = true
+		}
+	}
+
+	return rewrote
+}
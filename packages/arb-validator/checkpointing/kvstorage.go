@@ -0,0 +1,134 @@
+/*
+* Copyright 2020, Offchain Labs, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package checkpointing
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/offchainlabs/arbitrum/packages/arb-avm-cpp/cmachine"
+	"github.com/offchainlabs/arbitrum/packages/arb-util/common"
+	"github.com/offchainlabs/arbitrum/packages/arb-util/machine"
+	"github.com/offchainlabs/arbitrum/packages/arb-util/value"
+)
+
+// kvCheckpointStorage implements machine.CheckpointStorage on top of any
+// CheckpointBackend. It owns the value/machine (de)serialization that the
+// C++ machine store otherwise does internally, so that logic is written
+// once and shared by every pure-Go backend rather than duplicated per
+// backend.
+type kvCheckpointStorage struct {
+	backend CheckpointBackend
+}
+
+func newKVCheckpointStorage(backend CheckpointBackend) machine.CheckpointStorage {
+	return &kvCheckpointStorage{backend: backend}
+}
+
+// ensureInitialMachine loads the genesis AVM machine from arbCodeFilePath and
+// stores it under initialMachineKey, unless backend already has one. This is
+// the kv-backend equivalent of what cmachine.NewCheckpoint does internally
+// for the C++-backed store: without it, a fresh BoltBackend store has no way
+// to answer GetInitialMachine and a validator can never bootstrap.
+func ensureInitialMachine(backend CheckpointBackend, arbCodeFilePath string) error {
+	if backend.Get(initialMachineKey) != nil {
+		return nil
+	}
+	mach, err := cmachine.New(arbCodeFilePath)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := mach.MarshalForCheckpoint(&buf); err != nil {
+		return err
+	}
+	return backend.Put(initialMachineKey, buf.Bytes())
+}
+
+func (s *kvCheckpointStorage) GetData(key []byte) []byte {
+	return s.backend.Get(key)
+}
+
+func (s *kvCheckpointStorage) SaveData(key []byte, val []byte) bool {
+	return s.backend.Put(key, val) == nil
+}
+
+func (s *kvCheckpointStorage) DeleteData(key []byte) {
+	_ = s.backend.Delete(key)
+}
+
+func (s *kvCheckpointStorage) SaveValue(val value.Value) bool {
+	var buf bytes.Buffer
+	if err := value.MarshalValue(val, &buf); err != nil {
+		return false
+	}
+	key := append(append([]byte{}, valuePrefix...), val.Hash().Bytes()...)
+	return s.backend.Put(key, buf.Bytes()) == nil
+}
+
+func (s *kvCheckpointStorage) GetValue(h common.Hash) value.Value {
+	key := append(append([]byte{}, valuePrefix...), h.Bytes()...)
+	raw := s.backend.Get(key)
+	if raw == nil {
+		return nil
+	}
+	val, err := value.UnmarshalValue(bytes.NewReader(raw))
+	if err != nil {
+		return nil
+	}
+	return val
+}
+
+func (s *kvCheckpointStorage) DeleteValue(h common.Hash) {
+	key := append(append([]byte{}, valuePrefix...), h.Bytes()...)
+	s.backend.Delete(key)
+}
+
+func (s *kvCheckpointStorage) SaveMachine(mach machine.Machine) bool {
+	var buf bytes.Buffer
+	if err := mach.MarshalForCheckpoint(&buf); err != nil {
+		return false
+	}
+	key := append(append([]byte{}, machinePrefix...), mach.Hash().Bytes()...)
+	return s.backend.Put(key, buf.Bytes()) == nil
+}
+
+func (s *kvCheckpointStorage) GetMachine(h common.Hash) (machine.Machine, error) {
+	key := append(append([]byte{}, machinePrefix...), h.Bytes()...)
+	raw := s.backend.Get(key)
+	if raw == nil {
+		return nil, errors.New("machine not found in checkpoint storage")
+	}
+	return machine.UnmarshalMachineFromCheckpoint(bytes.NewReader(raw), s)
+}
+
+func (s *kvCheckpointStorage) DeleteCheckpoint(h common.Hash) {
+	key := append(append([]byte{}, machinePrefix...), h.Bytes()...)
+	s.backend.Delete(key)
+}
+
+func (s *kvCheckpointStorage) GetInitialMachine() (machine.Machine, error) {
+	raw := s.backend.Get(initialMachineKey)
+	if raw == nil {
+		return nil, errors.New("no initial machine in checkpoint storage")
+	}
+	return machine.UnmarshalMachineFromCheckpoint(bytes.NewReader(raw), s)
+}
+
+func (s *kvCheckpointStorage) CloseCheckpointStorage() {
+	_ = s.backend.Close()
+}
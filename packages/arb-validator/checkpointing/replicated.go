@@ -0,0 +1,385 @@
+/*
+* Copyright 2020, Offchain Labs, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package checkpointing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/clientv3/concurrency"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/offchainlabs/arbitrum/packages/arb-util/common"
+	"github.com/offchainlabs/arbitrum/packages/arb-util/machine"
+	"github.com/offchainlabs/arbitrum/packages/arb-util/value"
+	"github.com/offchainlabs/arbitrum/packages/arb-validator-core/arbbridge"
+)
+
+// ReplicatedCheckpointerConfig configures a ReplicatedCheckpointer.
+type ReplicatedCheckpointerConfig struct {
+	RollupAddr    common.Address
+	EtcdEndpoints []string
+	// ListenAddr is where this replica's ReplicationFetch gRPC service
+	// listens for peers pulling manifest entries it already has.
+	ListenAddr string
+}
+
+func etcdKeyPrefix(rollupAddr common.Address) string {
+	return "/arbitrum/checkpoint/" + rollupAddr.Hex() + "/"
+}
+
+func etcdHeadKey(rollupAddr common.Address) string {
+	return etcdKeyPrefix(rollupAddr) + "head"
+}
+
+func etcdElectionKey(rollupAddr common.Address) string {
+	return etcdKeyPrefix(rollupAddr) + "leader"
+}
+
+// ReplicatedCheckpointer wraps a RollupCheckpointerImpl so that every
+// AsyncSaveCheckpoint made while this replica holds the leader election also
+// writes the new head BlockId into an etcd cluster. Only the head BlockId is
+// written to etcd; the manifest is not. Peers do not watch that key: a peer
+// reads it once in RestoreLatestState, pulls whatever manifest entries it's
+// missing from the leader over a small gRPC service, and can take over
+// serving from the last agreed-upon checkpoint if the current leader
+// disappears.
+type ReplicatedCheckpointer struct {
+	*RollupCheckpointerImpl
+
+	cfg      ReplicatedCheckpointerConfig
+	etcd     *clientv3.Client
+	session  *concurrency.Session
+	election *concurrency.Election
+	grpcSrv  *grpc.Server
+}
+
+// NewReplicatedCheckpointer wraps inner, an already-constructed local
+// checkpointer, with etcd-backed head replication. inner continues to own
+// the actual on-disk storage; ReplicatedCheckpointer only adds the
+// mirroring, leader election and peer-fetch behavior on top.
+func NewReplicatedCheckpointer(ctx context.Context, inner *RollupCheckpointerImpl, cfg ReplicatedCheckpointerConfig) (*ReplicatedCheckpointer, error) {
+	cli, err := clientv3.New(clientv3.Config{Endpoints: cfg.EtcdEndpoints})
+	if err != nil {
+		return nil, err
+	}
+	session, err := concurrency.NewSession(cli)
+	if err != nil {
+		return nil, err
+	}
+	rc := &ReplicatedCheckpointer{
+		RollupCheckpointerImpl: inner,
+		cfg:                    cfg,
+		etcd:                   cli,
+		session:                session,
+		election:               concurrency.NewElection(session, etcdElectionKey(cfg.RollupAddr)),
+	}
+	if err := rc.serveFetches(); err != nil {
+		return nil, err
+	}
+	go rc.campaignForLeadership(ctx)
+	return rc, nil
+}
+
+// campaignForLeadership blocks in Campaign until it wins or ctx is
+// cancelled, so that at any time only one replica believes it's the leader
+// and is therefore allowed to advance the shared head in etcd.
+func (rc *ReplicatedCheckpointer) campaignForLeadership(ctx context.Context) {
+	if err := rc.election.Campaign(ctx, rc.cfg.ListenAddr); err != nil {
+		log.Println("replicated checkpointer: leadership campaign ended:", err)
+	}
+}
+
+func (rc *ReplicatedCheckpointer) isLeader() bool {
+	select {
+	case <-rc.session.Done():
+		return false
+	default:
+	}
+	resp, err := rc.election.Leader(context.Background())
+	return err == nil && len(resp.Kvs) > 0 && string(resp.Kvs[0].Value) == rc.cfg.ListenAddr
+}
+
+// AsyncSaveCheckpoint saves locally exactly as RollupCheckpointerImpl does,
+// then, if this replica currently holds the leader election, mirrors the
+// new head BlockId into etcd so standbys can follow along.
+func (rc *ReplicatedCheckpointer) AsyncSaveCheckpoint(blockId *common.BlockId, contents []byte, cpCtx CheckpointContext, closeWhenDone chan struct{}) {
+	done := make(chan struct{})
+	rc.RollupCheckpointerImpl.AsyncSaveCheckpoint(blockId, contents, cpCtx, done)
+	go func() {
+		<-done
+		if rc.isLeader() {
+			rc.publishHead(blockId)
+		}
+		if closeWhenDone != nil {
+			close(closeWhenDone)
+		}
+	}()
+}
+
+func (rc *ReplicatedCheckpointer) publishHead(blockId *common.BlockId) {
+	idBytes, err := proto.Marshal(blockId.MarshalToBuf())
+	if err != nil {
+		log.Println("replicated checkpointer: failed to marshal head:", err)
+		return
+	}
+	if _, err := rc.etcd.Put(context.Background(), etcdHeadKey(rc.cfg.RollupAddr), string(idBytes)); err != nil {
+		log.Println("replicated checkpointer: failed to publish head:", err)
+	}
+}
+
+// RestoreLatestState first consults etcd for the highest agreed-upon head,
+// pulls any manifest entries this replica is missing from the current
+// election leader, and restores that head. It falls back to
+// RollupCheckpointerImpl's own local restore only when etcd can't be read or
+// holds no head yet.
+func (rc *ReplicatedCheckpointer) RestoreLatestState(ctx context.Context, client arbbridge.ArbClient, unmarshalFunc func([]byte, RestoreContext) error) error {
+	resp, err := rc.etcd.Get(ctx, etcdHeadKey(rc.cfg.RollupAddr))
+	if err != nil {
+		return rc.RollupCheckpointerImpl.RestoreLatestState(ctx, client, unmarshalFunc)
+	}
+	if len(resp.Kvs) == 0 {
+		return rc.RollupCheckpointerImpl.RestoreLatestState(ctx, client, unmarshalFunc)
+	}
+
+	headIdBuf := &common.BlockIdBuf{}
+	if err := proto.Unmarshal(resp.Kvs[0].Value, headIdBuf); err != nil {
+		return err
+	}
+	headId := headIdBuf.Unmarshal()
+	if err := rc.pullMissingManifest(ctx, headId); err != nil {
+		return err
+	}
+	// pullMissingManifest only stores the entries headId's checkpoint needs;
+	// it doesn't move this replica's own CheckpointMetadata forward. Adopt
+	// headId as Newest (building CheckpointMetadata from scratch on a
+	// from-nothing standby) so RestoreCheckpoint below can actually find it.
+	if err := rc.adoptSnapshotHead(headId); err != nil {
+		return err
+	}
+
+	rc.RollupCheckpointerImpl.QueueReorgedCheckpointsForDeletion(ctx, client)
+	cobBytes, resCtx, err := rc.RestoreCheckpoint(headId)
+	if err != nil {
+		return err
+	}
+	if cobBytes == nil {
+		return errors.New("replicated checkpointer: head from etcd not found locally after sync")
+	}
+	return unmarshalFunc(cobBytes, resCtx)
+}
+
+// pullMissingManifest fetches, from the current election leader, headId's
+// manifest, contents and links entries, plus every value/machine the
+// manifest lists that this replica's local store doesn't already have. If
+// the manifest for headId is already stored locally, nothing is fetched.
+func (rc *ReplicatedCheckpointer) pullMissingManifest(ctx context.Context, headId *common.BlockId) error {
+	if rc.st.GetData(getManifestKey(headId)) != nil {
+		return nil
+	}
+
+	leaderResp, err := rc.election.Leader(ctx)
+	if err != nil {
+		return fmt.Errorf("replicated checkpointer: no leader to sync from: %w", err)
+	}
+	peerAddr := string(leaderResp.Kvs[0].Value)
+
+	conn, err := grpc.DialContext(ctx, peerAddr, grpc.WithInsecure())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fetchClient := NewReplicationFetchClient(conn)
+
+	headIdBytes, err := marshalBlockId(headId)
+	if err != nil {
+		return err
+	}
+
+	manifestData, err := fetchEntry(ctx, fetchClient, ReplicationEntryKind_ENTRY_MANIFEST, headIdBytes)
+	if err != nil {
+		return err
+	}
+	rc.st.SaveData(getManifestKey(headId), manifestData)
+
+	contentsData, err := fetchEntry(ctx, fetchClient, ReplicationEntryKind_ENTRY_CONTENTS, headIdBytes)
+	if err != nil {
+		return err
+	}
+	rc.st.SaveData(getContentsKey(headId), contentsData)
+
+	linksData, err := fetchEntry(ctx, fetchClient, ReplicationEntryKind_ENTRY_LINKS, headIdBytes)
+	if err != nil {
+		return err
+	}
+	rc.st.SaveData(getLinksKey(headId), linksData)
+
+	manifest := &CheckpointManifest{}
+	decoded, err := decompressValue(manifestData)
+	if err != nil {
+		return err
+	}
+	if err := proto.Unmarshal(decoded, manifest); err != nil {
+		return err
+	}
+	for _, vbuf := range manifest.Values {
+		h := vbuf.Unmarshal()
+		if rc.st.GetValue(h) != nil {
+			continue
+		}
+		data, err := fetchEntry(ctx, fetchClient, ReplicationEntryKind_ENTRY_VALUE, h.Bytes())
+		if err != nil {
+			return err
+		}
+		val, err := value.UnmarshalValue(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if !rc.st.SaveValue(val) {
+			return fmt.Errorf("replicated checkpointer: failed to save synced value %v", h)
+		}
+	}
+	for _, mbuf := range manifest.Machines {
+		h := mbuf.Unmarshal()
+		if _, err := rc.st.GetMachine(h); err == nil {
+			continue
+		}
+		data, err := fetchEntry(ctx, fetchClient, ReplicationEntryKind_ENTRY_MACHINE, h.Bytes())
+		if err != nil {
+			return err
+		}
+		mach, err := machine.UnmarshalMachineFromCheckpoint(bytes.NewReader(data), rc.st)
+		if err != nil {
+			return err
+		}
+		if !rc.st.SaveMachine(mach) {
+			return fmt.Errorf("replicated checkpointer: failed to save synced machine %v", h)
+		}
+	}
+	return nil
+}
+
+// marshalBlockId/unmarshalBlockId serialize a full BlockId (height and
+// header hash), not just its hash. getManifestKey/getContentsKey key their
+// entries off the full BlockId, so FetchEntryRequest.Hash for those two
+// entry kinds must carry the same thing or the lookup on the serving side
+// misses.
+func marshalBlockId(id *common.BlockId) ([]byte, error) {
+	return proto.Marshal(id.MarshalToBuf())
+}
+
+func unmarshalBlockId(data []byte) (*common.BlockId, error) {
+	buf := &common.BlockIdBuf{}
+	if err := proto.Unmarshal(data, buf); err != nil {
+		return nil, err
+	}
+	return buf.Unmarshal(), nil
+}
+
+func fetchEntry(ctx context.Context, client ReplicationFetchClient, kind ReplicationEntryKind, hash []byte) ([]byte, error) {
+	resp, err := client.FetchEntry(ctx, &FetchEntryRequest{Kind: kind, Hash: hash})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Found {
+		return nil, fmt.Errorf("replicated checkpointer: peer doesn't have entry kind %v", kind)
+	}
+	return resp.Data, nil
+}
+
+// serveFetches starts the small gRPC service peers use to pull manifest
+// entries this replica already holds in its local machine.CheckpointStorage.
+func (rc *ReplicatedCheckpointer) serveFetches() error {
+	lis, err := net.Listen("tcp", rc.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	rc.grpcSrv = grpc.NewServer()
+	RegisterReplicationFetchServer(rc.grpcSrv, &replicationFetchServer{rc: rc})
+	go func() {
+		if err := rc.grpcSrv.Serve(lis); err != nil {
+			log.Println("replicated checkpointer: fetch server stopped:", err)
+		}
+	}()
+	return nil
+}
+
+type replicationFetchServer struct {
+	UnimplementedReplicationFetchServer
+	rc *ReplicatedCheckpointer
+}
+
+func (s *replicationFetchServer) FetchEntry(ctx context.Context, req *FetchEntryRequest) (*FetchEntryResponse, error) {
+	switch req.Kind {
+	case ReplicationEntryKind_ENTRY_VALUE:
+		var h common.Hash
+		copy(h[:], req.Hash)
+		val := s.rc.st.GetValue(h)
+		if val == nil {
+			return &FetchEntryResponse{Found: false}, nil
+		}
+		var buf bytes.Buffer
+		if err := value.MarshalValue(val, &buf); err != nil {
+			return nil, err
+		}
+		return &FetchEntryResponse{Found: true, Data: buf.Bytes()}, nil
+	case ReplicationEntryKind_ENTRY_MACHINE:
+		var h common.Hash
+		copy(h[:], req.Hash)
+		mach, err := s.rc.st.GetMachine(h)
+		if err != nil {
+			return &FetchEntryResponse{Found: false}, nil
+		}
+		var buf bytes.Buffer
+		if err := mach.MarshalForCheckpoint(&buf); err != nil {
+			return nil, err
+		}
+		return &FetchEntryResponse{Found: true, Data: buf.Bytes()}, nil
+	case ReplicationEntryKind_ENTRY_CONTENTS, ReplicationEntryKind_ENTRY_MANIFEST, ReplicationEntryKind_ENTRY_LINKS:
+		blockId, err := unmarshalBlockId(req.Hash)
+		if err != nil {
+			return nil, err
+		}
+		var raw []byte
+		switch req.Kind {
+		case ReplicationEntryKind_ENTRY_CONTENTS:
+			raw = s.rc.st.GetData(getContentsKey(blockId))
+		case ReplicationEntryKind_ENTRY_MANIFEST:
+			raw = s.rc.st.GetData(getManifestKey(blockId))
+		default:
+			raw = s.rc.st.GetData(getLinksKey(blockId))
+		}
+		return &FetchEntryResponse{Found: raw != nil, Data: raw}, nil
+	default:
+		return &FetchEntryResponse{Found: false}, nil
+	}
+}
+
+// Close stops the fetch server and releases the etcd session alongside the
+// wrapped local checkpointer.
+func (rc *ReplicatedCheckpointer) Close() {
+	rc.grpcSrv.GracefulStop()
+	_ = rc.session.Close()
+	_ = rc.etcd.Close()
+	rc.RollupCheckpointerImpl.Close()
+}
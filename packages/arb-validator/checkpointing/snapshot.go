@@ -0,0 +1,280 @@
+/*
+* Copyright 2020, Offchain Labs, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package checkpointing
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/offchainlabs/arbitrum/packages/arb-util/common"
+)
+
+// snapshotFormatVersion versions the framed archive format produced by
+// ExportSnapshot/consumed by ImportSnapshot, independent of
+// CheckpointMetadata.FormatVersion.
+const snapshotFormatVersion = 1
+
+// snapshot frame kinds, written in this order by ExportSnapshot.
+const (
+	snapshotFrameManifest byte = iota
+	snapshotFrameContents
+	snapshotFrameLinks
+	snapshotFrameValue
+	snapshotFrameMachine
+)
+
+// ExportSnapshot streams a self-contained archive of the checkpoint at
+// blockId: its manifest, contents, links, and every value/machine the
+// manifest lists. Values or machines referenced only from inside those
+// entries are not walked. A peer can ImportSnapshot this archive
+// to seed a fresh validator without replaying the chain from L1.
+func (rcp *RollupCheckpointerImpl) ExportSnapshot(ctx context.Context, w io.Writer, blockId *common.BlockId) error {
+	// manifestStored/contentsStored are exactly the bytes SaveCheckpoint
+	// wrote - compression header included. They're written to the archive
+	// verbatim so ImportSnapshot can hand them straight back to SaveData
+	// without needing to know or re-derive the codec they were written
+	// with; only a throwaway decompressed copy is parsed here to walk the
+	// manifest's value/machine hashes.
+	manifestStored := rcp.st.GetData(getManifestKey(blockId))
+	if manifestStored == nil {
+		return fmt.Errorf("snapshot: no checkpoint for block %v", blockId)
+	}
+	manifestRaw, err := decompressValue(manifestStored)
+	if err != nil {
+		return err
+	}
+	manifest := &CheckpointManifest{}
+	if err := proto.Unmarshal(manifestRaw, manifest); err != nil {
+		return err
+	}
+	contentsStored := rcp.st.GetData(getContentsKey(blockId))
+	linksRaw := rcp.st.GetData(getLinksKey(blockId))
+
+	if err := writeSnapshotHeader(w, blockId); err != nil {
+		return err
+	}
+	if err := writeSnapshotFrame(w, snapshotFrameManifest, manifestStored); err != nil {
+		return err
+	}
+	if err := writeSnapshotFrame(w, snapshotFrameContents, contentsStored); err != nil {
+		return err
+	}
+	if err := writeSnapshotFrame(w, snapshotFrameLinks, linksRaw); err != nil {
+		return err
+	}
+	for _, vbuf := range manifest.Values {
+		h := vbuf.Unmarshal()
+		raw := rcp.st.GetData(append(append([]byte{}, valuePrefix...), h.Bytes()...))
+		if err := writeSnapshotEntry(w, snapshotFrameValue, h, raw); err != nil {
+			return err
+		}
+	}
+	for _, mbuf := range manifest.Machines {
+		h := mbuf.Unmarshal()
+		raw := rcp.st.GetData(append(append([]byte{}, machinePrefix...), h.Bytes()...))
+		if err := writeSnapshotEntry(w, snapshotFrameMachine, h, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportSnapshot consumes an archive written by ExportSnapshot. It is
+// idempotent: entries that already exist locally are left untouched, and
+// the call can be retried safely if it's interrupted partway through.
+// CheckpointMetadata is created if this store doesn't have one yet, and
+// ImportSnapshot refuses to move Newest backward over a checkpoint that's
+// already more recent.
+func (rcp *RollupCheckpointerImpl) ImportSnapshot(ctx context.Context, r io.Reader) error {
+	blockId, err := readSnapshotHeader(r)
+	if err != nil {
+		return err
+	}
+
+	for {
+		kind, hash, data, err := readSnapshotFrame(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case snapshotFrameManifest:
+			if key := getManifestKey(blockId); rcp.st.GetData(key) == nil {
+				rcp.st.SaveData(key, data)
+			}
+		case snapshotFrameContents:
+			if key := getContentsKey(blockId); rcp.st.GetData(key) == nil {
+				rcp.st.SaveData(key, data)
+			}
+		case snapshotFrameLinks:
+			if key := getLinksKey(blockId); rcp.st.GetData(key) == nil {
+				rcp.st.SaveData(key, data)
+			}
+		case snapshotFrameValue:
+			key := append(append([]byte{}, valuePrefix...), hash.Bytes()...)
+			if rcp.st.GetData(key) == nil {
+				rcp.st.SaveData(key, data)
+			}
+		case snapshotFrameMachine:
+			key := append(append([]byte{}, machinePrefix...), hash.Bytes()...)
+			if rcp.st.GetData(key) == nil {
+				rcp.st.SaveData(key, data)
+			}
+		default:
+			return fmt.Errorf("snapshot: unknown frame kind %d", kind)
+		}
+	}
+
+	return rcp.adoptSnapshotHead(blockId)
+}
+
+// adoptSnapshotHead rebuilds CheckpointMetadata if this store has none yet,
+// and otherwise only advances Newest to blockId - it never moves Newest
+// backward over a checkpoint this store already considers more recent.
+func (rcp *RollupCheckpointerImpl) adoptSnapshotHead(blockId *common.BlockId) error {
+	rawMetadata := rcp.RestoreMetadata()
+	if len(rawMetadata) == 0 {
+		idBuf := blockId.MarshalToBuf()
+		metadata := &CheckpointMetadata{
+			FormatVersion: 1,
+			Oldest:        idBuf,
+			Newest:        idBuf,
+		}
+		buf, err := proto.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		rcp.SaveMetadata(buf)
+		return nil
+	}
+
+	metadata := &CheckpointMetadata{}
+	if err := proto.Unmarshal(rawMetadata, metadata); err != nil {
+		return err
+	}
+	newest := metadata.Newest.Unmarshal()
+	if newest != nil && newest.Height.Cmp(blockId.Height) >= 0 {
+		// already at least as recent as the imported snapshot; nothing to do
+		return nil
+	}
+	metadata.Newest = blockId.MarshalToBuf()
+	buf, err := proto.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	rcp.SaveMetadata(buf)
+	return nil
+}
+
+func writeSnapshotHeader(w io.Writer, blockId *common.BlockId) error {
+	idBuf, err := proto.Marshal(blockId.MarshalToBuf())
+	if err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(snapshotFormatVersion)); err != nil {
+		return err
+	}
+	return writeFrameBytes(w, idBuf)
+}
+
+func readSnapshotHeader(r io.Reader) (*common.BlockId, error) {
+	var version uint32
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, err
+	}
+	if version != snapshotFormatVersion {
+		return nil, fmt.Errorf("snapshot: unsupported format version %d", version)
+	}
+	idBuf, err := readFrameBytes(r)
+	if err != nil {
+		return nil, err
+	}
+	blockIdBuf := &common.BlockIdBuf{}
+	if err := proto.Unmarshal(idBuf, blockIdBuf); err != nil {
+		return nil, err
+	}
+	return blockIdBuf.Unmarshal(), nil
+}
+
+// writeSnapshotFrame writes a frame with no hash of its own (manifest,
+// contents, links - each implicitly keyed by the snapshot's root BlockId).
+func writeSnapshotFrame(w io.Writer, kind byte, data []byte) error {
+	if _, err := w.Write([]byte{kind}); err != nil {
+		return err
+	}
+	return writeFrameBytes(w, data)
+}
+
+// writeSnapshotEntry writes a frame for a value/machine, content-addressed
+// by hash.
+func writeSnapshotEntry(w io.Writer, kind byte, hash common.Hash, data []byte) error {
+	if _, err := w.Write([]byte{kind}); err != nil {
+		return err
+	}
+	if err := writeFrameBytes(w, hash.Bytes()); err != nil {
+		return err
+	}
+	return writeFrameBytes(w, data)
+}
+
+func readSnapshotFrame(r io.Reader) (kind byte, hash common.Hash, data []byte, err error) {
+	kindBuf := make([]byte, 1)
+	if _, err = io.ReadFull(r, kindBuf); err != nil {
+		return 0, common.Hash{}, nil, err
+	}
+	kind = kindBuf[0]
+
+	if kind == snapshotFrameValue || kind == snapshotFrameMachine {
+		hashBytes, err := readFrameBytes(r)
+		if err != nil {
+			return 0, common.Hash{}, nil, err
+		}
+		copy(hash[:], hashBytes)
+	}
+
+	data, err = readFrameBytes(r)
+	if err != nil {
+		return 0, common.Hash{}, nil, err
+	}
+	return kind, hash, data, nil
+}
+
+func writeFrameBytes(w io.Writer, data []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readFrameBytes(r io.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
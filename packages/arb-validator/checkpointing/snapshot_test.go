@@ -0,0 +1,151 @@
+/*
+* Copyright 2020, Offchain Labs, Inc.
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You may obtain a copy of the License at
+*
+*    http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+ */
+
+package checkpointing
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/offchainlabs/arbitrum/packages/arb-util/common"
+)
+
+func testBlockId(t *testing.T, height int64) *common.BlockId {
+	t.Helper()
+	var hash common.Hash
+	hash[0] = byte(height)
+	return &common.BlockId{
+		Height:     common.NewTimeBlocks(big.NewInt(height)),
+		HeaderHash: hash,
+	}
+}
+
+func newTestCheckpointer(t *testing.T) *RollupCheckpointerImpl {
+	t.Helper()
+	backend := newTestBoltBackend(t)
+	return &RollupCheckpointerImpl{
+		st:          newKVCheckpointStorage(backend),
+		backend:     backend,
+		compression: DefaultCompressionOptions(),
+	}
+}
+
+// populateCheckpoint writes the manifest/contents/links entries ExportSnapshot
+// reads, without going through the full SaveCheckpoint path.
+func populateCheckpoint(t *testing.T, rcp *RollupCheckpointerImpl, blockId *common.BlockId, contents []byte) {
+	t.Helper()
+	manifestBuf, err := proto.Marshal(&CheckpointManifest{})
+	if err != nil {
+		t.Fatalf("proto.Marshal(manifest): %v", err)
+	}
+	links := &CheckpointLinks{Prev: blockId.MarshalToBuf(), Next: blockId.MarshalToBuf()}
+	linksBuf, err := proto.Marshal(links)
+	if err != nil {
+		t.Fatalf("proto.Marshal(links): %v", err)
+	}
+
+	rcp.st.SaveData(getManifestKey(blockId), rcp.maybeCompress(manifestBuf))
+	rcp.st.SaveData(getContentsKey(blockId), rcp.maybeCompress(contents))
+	rcp.st.SaveData(getLinksKey(blockId), linksBuf)
+}
+
+func TestExportImportSnapshotRoundTrip(t *testing.T) {
+	rcp := newTestCheckpointer(t)
+	blockId := testBlockId(t, 5)
+	populateCheckpoint(t, rcp, blockId, []byte("checkpoint contents"))
+
+	var archive bytes.Buffer
+	if err := rcp.ExportSnapshot(context.Background(), &archive, blockId); err != nil {
+		t.Fatalf("ExportSnapshot: %v", err)
+	}
+
+	imported := newTestCheckpointer(t)
+	if err := imported.ImportSnapshot(context.Background(), &archive); err != nil {
+		t.Fatalf("ImportSnapshot: %v", err)
+	}
+
+	wantManifest := rcp.st.GetData(getManifestKey(blockId))
+	if got := imported.st.GetData(getManifestKey(blockId)); !bytes.Equal(got, wantManifest) {
+		t.Fatalf("imported manifest = %x, want %x", got, wantManifest)
+	}
+	wantContents := rcp.st.GetData(getContentsKey(blockId))
+	if got := imported.st.GetData(getContentsKey(blockId)); !bytes.Equal(got, wantContents) {
+		t.Fatalf("imported contents = %x, want %x", got, wantContents)
+	}
+
+	rawMetadata := imported.RestoreMetadata()
+	if len(rawMetadata) == 0 {
+		t.Fatal("ImportSnapshot did not create CheckpointMetadata")
+	}
+	metadata := &CheckpointMetadata{}
+	if err := proto.Unmarshal(rawMetadata, metadata); err != nil {
+		t.Fatalf("proto.Unmarshal(metadata): %v", err)
+	}
+	if got := metadata.Newest.Unmarshal().Height.Cmp(blockId.Height); got != 0 {
+		t.Fatalf("imported Newest height Cmp = %d, want 0", got)
+	}
+}
+
+func TestImportSnapshotIsIdempotent(t *testing.T) {
+	rcp := newTestCheckpointer(t)
+	blockId := testBlockId(t, 5)
+	populateCheckpoint(t, rcp, blockId, []byte("checkpoint contents"))
+
+	archive := func() []byte {
+		var buf bytes.Buffer
+		if err := rcp.ExportSnapshot(context.Background(), &buf, blockId); err != nil {
+			t.Fatalf("ExportSnapshot: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	imported := newTestCheckpointer(t)
+	if err := imported.ImportSnapshot(context.Background(), bytes.NewReader(archive())); err != nil {
+		t.Fatalf("ImportSnapshot (first): %v", err)
+	}
+	firstManifest := imported.st.GetData(getManifestKey(blockId))
+
+	// Replaying the same archive must not error or change anything already
+	// imported.
+	if err := imported.ImportSnapshot(context.Background(), bytes.NewReader(archive())); err != nil {
+		t.Fatalf("ImportSnapshot (replay): %v", err)
+	}
+	if got := imported.st.GetData(getManifestKey(blockId)); !bytes.Equal(got, firstManifest) {
+		t.Fatalf("manifest changed across replay: got %x, want %x", got, firstManifest)
+	}
+
+	// ImportSnapshot must never move Newest backward over a checkpoint this
+	// store already considers more recent.
+	newerId := testBlockId(t, 10)
+	if err := imported.adoptSnapshotHead(newerId); err != nil {
+		t.Fatalf("adoptSnapshotHead: %v", err)
+	}
+	if err := imported.ImportSnapshot(context.Background(), bytes.NewReader(archive())); err != nil {
+		t.Fatalf("ImportSnapshot (older replay): %v", err)
+	}
+	rawMetadata := imported.RestoreMetadata()
+	metadata := &CheckpointMetadata{}
+	if err := proto.Unmarshal(rawMetadata, metadata); err != nil {
+		t.Fatalf("proto.Unmarshal(metadata): %v", err)
+	}
+	if got := metadata.Newest.Unmarshal().Height.Cmp(newerId.Height); got != 0 {
+		t.Fatalf("Newest regressed after importing an older snapshot: Cmp = %d, want 0", got)
+	}
+}